@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
+)
+
+// keysBucket holds one keyRecord per key ID in metaDB, replacing the old flat
+// StorageDir/keys newline file.
+var keysBucket = []byte("keys")
+
+// keyRecord describes an upload key: its owner, lifetime, usage quota and the
+// scopes it's restricted to. The plaintext key is never stored, only its
+// argon2id hash.
+type keyRecord struct {
+	ID           string   `json:"id"`
+	HashedSecret string   `json:"hashed_secret"`
+	Owner        string   `json:"owner"`
+	CreatedAt    int64    `json:"created_at"`
+	ExpiresAt    int64    `json:"expires_at"` // 0 = never
+	ByteQuota    int64    `json:"byte_quota"` // total bytes this key may ever upload; 0 = unlimited
+	BytesUsed    int64    `json:"bytes_used"`
+	MaxFileSize  int64    `json:"max_file_size"` // per-upload MB cap, overriding ATAERU_MAX_FILE_SIZE; 0 = use global
+	MimeScopes   []string `json:"mime_scopes"`   // glob patterns this key may upload; empty = inherit ATAERU_MIME_ALLOW/DENY
+	Revoked      bool     `json:"revoked"`
+	// Legacy marks a key imported from the old flat keys file: the whole
+	// presented string is the secret (there's no "<id>.<secret>" split), and
+	// its ID is derived from the secret itself so lookups stay O(1).
+	Legacy bool `json:"legacy"`
+}
+
+// hashSecret argon2id-hashes secret with a fresh random salt, encoding both
+// into a single "<salt>$<hash>" base64 string so verifySecret is self
+// contained
+func hashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(secret), salt, 1, 64*1024, 4, 32)
+
+	return base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash), nil
+}
+
+// verifySecret checks secret against a hash produced by hashSecret
+func verifySecret(secret, encoded string) bool {
+	parts := strings.SplitN(encoded, "$", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(secret), salt, 1, 64*1024, 4, 32)
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// legacyKeyID derives the deterministic bucket key a migrated flat-file key
+// is stored under, so a bare (non "id.secret") presented key can still be
+// looked up in one bbolt Get
+func legacyKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "legacy-" + hex.EncodeToString(sum[:])[:16]
+}
+
+func getKeyRecord(id string) (*keyRecord, bool) {
+	var rec keyRecord
+	found := false
+
+	metaDB.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(keysBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+
+	if !found {
+		return nil, false
+	}
+	return &rec, true
+}
+
+func putKeyRecord(rec *keyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return metaDB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(rec.ID), data)
+	})
+}
+
+func listKeyRecords() ([]keyRecord, error) {
+	var records []keyRecord
+
+	err := metaDB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(k, v []byte) error {
+			var rec keyRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+
+	return records, err
+}
+
+// reserveKeyQuota re-reads id's record inside a single bbolt transaction,
+// runs checkKeyLimits against that up-to-date BytesUsed, and — only if it
+// passes — bumps BytesUsed by size in the same transaction. Doing the check
+// and the increment as one atomic step (rather than checkKeyLimits before
+// the upload and a separate increment after) closes the race where two
+// concurrent uploads on the same key each read a BytesUsed that's still
+// under quota, both pass, and together exceed it.
+func reserveKeyQuota(id string, size int64, mtype string) error {
+	return metaDB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+
+		data := b.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("key %s no longer exists", id)
+		}
+
+		var rec keyRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+
+		if err := checkKeyLimits(&rec, size, mtype); err != nil {
+			return err
+		}
+
+		rec.BytesUsed += size
+
+		encoded, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(id), encoded)
+	})
+}
+
+// newUploadKey mints a fresh "<id>.<secret>" key, persisting its hashed form
+// and returning the plaintext to hand back to the caller exactly once
+func newUploadKey(owner string, ttlHours, byteQuota, maxFileSize int64, mimeScopes []string) (string, *keyRecord, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	secretBytes := make([]byte, 24)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, err
+	}
+
+	id := hex.EncodeToString(idBytes)
+	secret := hex.EncodeToString(secretBytes)
+
+	hashed, err := hashSecret(secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var expiresAt int64
+	if ttlHours > 0 {
+		expiresAt = time.Now().Add(time.Duration(ttlHours) * time.Hour).Unix()
+	}
+
+	rec := &keyRecord{
+		ID:           id,
+		HashedSecret: hashed,
+		Owner:        owner,
+		CreatedAt:    time.Now().Unix(),
+		ExpiresAt:    expiresAt,
+		ByteQuota:    byteQuota,
+		MaxFileSize:  maxFileSize,
+		MimeScopes:   mimeScopes,
+	}
+
+	if err := putKeyRecord(rec); err != nil {
+		return "", nil, err
+	}
+
+	return id + "." + secret, rec, nil
+}
+
+// lookupKey resolves a presented upload key (either the new "<id>.<secret>"
+// format or a migrated legacy flat-file key) to its stored record, verifying
+// the secret against the argon2id hash before returning it
+func lookupKey(key string) (*keyRecord, error) {
+	if parts := strings.SplitN(key, ".", 2); len(parts) == 2 {
+		id, secret := parts[0], parts[1]
+		rec, found := getKeyRecord(id)
+		if !found || rec.Legacy || !verifySecret(secret, rec.HashedSecret) {
+			return nil, fmt.Errorf("invalid key")
+		}
+		return rec, nil
+	}
+
+	rec, found := getKeyRecord(legacyKeyID(key))
+	if !found || !rec.Legacy || !verifySecret(key, rec.HashedSecret) {
+		return nil, fmt.Errorf("invalid key")
+	}
+	return rec, nil
+}
+
+// validateUploadKey runs the cheap, size-independent checks (existence,
+// revocation, expiry) against a presented key
+func validateUploadKey(key string) (*keyRecord, error) {
+	rec, err := lookupKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.Revoked {
+		return nil, fmt.Errorf("this key has been revoked")
+	}
+
+	if rec.ExpiresAt > 0 && time.Now().Unix() > rec.ExpiresAt {
+		return nil, fmt.Errorf("this key has expired")
+	}
+
+	return rec, nil
+}
+
+// checkKeyLimits runs the checks that need the upload's size and MIME type:
+// the key's byte quota, its per-key max file size override, and its MIME
+// scope allowlist
+func checkKeyLimits(rec *keyRecord, size int64, mtype string) error {
+	if rec.ByteQuota > 0 && rec.BytesUsed+size > rec.ByteQuota {
+		return fmt.Errorf("this key has exceeded its upload quota")
+	}
+
+	if rec.MaxFileSize > 0 && size > mbToBytes(rec.MaxFileSize) {
+		return fmt.Errorf("the maximum file size for this key is %dMB", rec.MaxFileSize)
+	}
+
+	if len(rec.MimeScopes) > 0 {
+		allowed := false
+		for _, pattern := range rec.MimeScopes {
+			if mimeMatches(pattern, mtype) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("this key is not scoped to upload %s", mtype)
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyKeys imports every line of the old flat StorageDir/keys file
+// into keysBucket, but only on first startup: if keysBucket already holds any
+// record we assume the migration already ran and leave usage counters alone
+func migrateLegacyKeys(storageDir string) error {
+	existing, err := listKeyRecords()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(storageDir, "keys"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		hashed, err := hashSecret(line)
+		if err != nil {
+			return err
+		}
+
+		rec := &keyRecord{
+			ID:           legacyKeyID(line),
+			HashedSecret: hashed,
+			Owner:        "legacy-import",
+			CreatedAt:    time.Now().Unix(),
+			Legacy:       true,
+		}
+
+		if err := putKeyRecord(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Admin API: /admin/keys, guarded by a Bearer ATAERU_ADMIN_TOKEN */
+
+func adminAuthorized(r *http.Request) bool {
+	token := APP_CONFIG.AdminToken
+	if token == "" {
+		return false
+	}
+
+	got := r.Header.Get("Authorization")
+	want := "Bearer " + token
+
+	// same constant-time comparison verifySecret uses for key secrets; the
+	// admin token gates minting/listing/revoking every key in the store
+	return len(got) == len(want) && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// adminKeysHandler dispatches the admin key management verbs: POST mints a
+// key, GET lists existing keys, DELETE revokes one by ID
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		adminCreateKey(w, r)
+	case http.MethodGet:
+		adminListKeys(w, r)
+	case http.MethodDelete:
+		adminRevokeKey(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type createKeyRequest struct {
+	Owner       string   `json:"owner"`
+	TTL         int64    `json:"ttl"`           // hours; 0 = never expires
+	ByteQuota   int64    `json:"byte_quota"`    // 0 = unlimited
+	MaxFileSize int64    `json:"max_file_size"` // MB; 0 = use global default
+	MimeScopes  []string `json:"mime_scopes"`
+}
+
+func adminCreateKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	key, rec, err := newUploadKey(req.Owner, req.TTL, req.ByteQuota, req.MaxFileSize, req.MimeScopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Key string `json:"key"`
+		*keyRecord
+	}{Key: key, keyRecord: rec})
+}
+
+func adminListKeys(w http.ResponseWriter, r *http.Request) {
+	records, err := listKeyRecords()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+func adminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+	if id == "" {
+		http.Error(w, "missing key ID", http.StatusBadRequest)
+		return
+	}
+
+	rec, found := getKeyRecord(id)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	rec.Revoked = true
+	if err := putKeyRecord(rec); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
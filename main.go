@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -33,6 +35,26 @@ type config struct {
 	StorageDir   string
 	MaxFileSize  int64 // in mb
 	PublicUpload bool
+
+	// StorageDriver selects the Storage backend ("local" or "s3")
+	StorageDriver string
+	S3Bucket      string
+	S3Endpoint    string
+
+	// DefaultTTL/MaxTTL are in hours; 0 means "no expiration"
+	DefaultTTL   int64
+	MaxTTL       int64
+	SecureDelete bool
+
+	// MIME glob lists, e.g. "image/*", "application/x-msdownload"
+	MimeAllow []string
+	MimeDeny  []string
+
+	// MaxOpenFiles is the RLIMIT_NOFILE cap applied by applySandbox
+	MaxOpenFiles int64
+
+	// AdminToken guards /admin/keys; the admin API is disabled when empty
+	AdminToken string
 }
 
 func getEnvOrDefault(key string, defaultVal string) string {
@@ -47,33 +69,6 @@ func mbToBytes(mb int64) int64 {
 	return mb << 20
 }
 
-func getBufferFileHash(buf *[]byte) string {
-	hash := md5.New()
-	return hex.EncodeToString(hash.Sum(*buf)[:16])
-}
-
-func isUploadKeyValid(key string) bool {
-	// check if key is in keyfile
-	keyFile, err := os.Open(filepath.Join(APP_CONFIG.StorageDir, "/keys"))
-	if err != nil {
-		log.Printf("Error while opening keyfile: %s", err.Error())
-		return false
-	}
-
-	validKey := false
-	scanner := bufio.NewScanner(keyFile)
-	for scanner.Scan() {
-		if key == scanner.Text() {
-			validKey = true
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error while reading from scanner: %s", err)
-	}
-
-	return validKey
-}
-
 // initializeEnv initializes program configuration from enviroment variables and ensure directory structure is created
 func initializeEnv() (config, error) {
 	var conf config
@@ -83,6 +78,16 @@ func initializeEnv() (config, error) {
 	storageDir := getEnvOrDefault("ATAERU_STORAGE_DIR", ATAERU_STORAGE_DIR)
 	maxFileSize := getEnvOrDefault("ATAERU_MAX_FILE_SIZE", ATAERU_MAX_FILE_SIZE)
 	publicUpload := getEnvOrDefault("ATAERU_PUBLIC_UPLOAD", ATAERU_PUBLIC_UPLOAD)
+	storageDriver := getEnvOrDefault("ATAERU_STORAGE_DRIVER", "local")
+	s3Bucket := os.Getenv("ATAERU_S3_BUCKET")
+	s3Endpoint := os.Getenv("ATAERU_S3_ENDPOINT")
+	defaultTTL := getEnvOrDefault("ATAERU_DEFAULT_TTL", "0")
+	maxTTL := getEnvOrDefault("ATAERU_MAX_TTL", "0")
+	secureDelete := getEnvOrDefault("ATAERU_SECURE_DELETE", "false")
+	mimeAllow := splitCSV(os.Getenv("ATAERU_MIME_ALLOW"))
+	mimeDeny := splitCSV(os.Getenv("ATAERU_MIME_DENY"))
+	maxOpenFiles := getEnvOrDefault("ATAERU_MAX_OPEN_FILES", "1024")
+	adminToken := os.Getenv("ATAERU_ADMIN_TOKEN")
 
 	// if the storageDir path doesn't exist, create it!
 	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
@@ -90,12 +95,27 @@ func initializeEnv() (config, error) {
 			return conf, fmt.Errorf("Error while trying to create storage directory: %s", err.Error())
 		}
 
-		if err = os.MkdirAll(filepath.Join(storageDir, "/files"), os.ModePerm); err != nil {
-			return conf, fmt.Errorf("Error while trying to create files directory: %s", err.Error())
+		// files/hashes only live on disk when we're backed by the local driver;
+		// an S3 bucket has no local directory structure to create
+		if storageDriver == "local" {
+			if err = os.MkdirAll(filepath.Join(storageDir, "/files"), os.ModePerm); err != nil {
+				return conf, fmt.Errorf("Error while trying to create files directory: %s", err.Error())
+			}
+
+			if err = os.MkdirAll(filepath.Join(storageDir, "/hashes"), os.ModePerm); err != nil {
+				return conf, fmt.Errorf("Error while trying to create hashes directory: %s", err.Error())
+			}
+		}
+
+		if err = os.MkdirAll(filepath.Join(storageDir, "/uploads"), os.ModePerm); err != nil {
+			return conf, fmt.Errorf("Error while trying to create uploads directory: %s", err.Error())
 		}
 
-		if err = os.MkdirAll(filepath.Join(storageDir, "/hashes"), os.ModePerm); err != nil {
-			return conf, fmt.Errorf("Error while trying to create hashes directory: %s", err.Error())
+		// staging area for streamed uploads (see stageUpload); needed even
+		// with the s3 driver, since the upload is hashed to local disk
+		// before it's shipped to the bucket
+		if err = os.MkdirAll(filepath.Join(storageDir, "/tmp"), os.ModePerm); err != nil {
+			return conf, fmt.Errorf("Error while trying to create tmp directory: %s", err.Error())
 		}
 
 		if _, err := os.Create(filepath.Join(storageDir, "/keys")); err != nil {
@@ -106,12 +126,31 @@ func initializeEnv() (config, error) {
 	// convert non string values
 	maxFileSizeConv, err := strconv.ParseInt(maxFileSize, 10, 64)
 	publicUploadConv, err := strconv.ParseBool(publicUpload)
+	defaultTTLConv, err := strconv.ParseInt(defaultTTL, 10, 64)
+	maxTTLConv, err := strconv.ParseInt(maxTTL, 10, 64)
+	secureDeleteConv, err := strconv.ParseBool(secureDelete)
+	maxOpenFilesConv, err := strconv.ParseInt(maxOpenFiles, 10, 64)
 	if err != nil {
 		return conf, fmt.Errorf("Error while converting strings to native values: %s", err.Error())
 	}
 
 	// init our conf struct
-	conf = config{Port: port, StorageDir: storageDir, MaxFileSize: maxFileSizeConv, PublicUpload: publicUploadConv}
+	conf = config{
+		Port:          port,
+		StorageDir:    storageDir,
+		MaxFileSize:   maxFileSizeConv,
+		PublicUpload:  publicUploadConv,
+		StorageDriver: storageDriver,
+		S3Bucket:      s3Bucket,
+		S3Endpoint:    s3Endpoint,
+		DefaultTTL:    defaultTTLConv,
+		MaxTTL:        maxTTLConv,
+		SecureDelete:  secureDeleteConv,
+		MimeAllow:     mimeAllow,
+		MimeDeny:      mimeDeny,
+		MaxOpenFiles:  maxOpenFilesConv,
+		AdminToken:    adminToken,
+	}
 
 	return conf, nil
 }
@@ -152,98 +191,409 @@ func landingPage(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("<h1>Ataeru</h1>"))
 }
 
+// storageHandler streams an uploaded file out of APP_STORAGE, or deletes one
+// given a valid ?token= (see getOrCreateDeleteToken). It replaces
+// http.FileServer so non-local backends (S3) can serve /storage/ too, while
+// still going through http.ServeContent for Range/conditional-GET support
+// when the backend's reader happens to be seekable (the local driver).
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		if err := deleteByToken(r.URL.Path, r.URL.Query().Get("token")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	name := "files/" + r.URL.Path
+
+	info, err := APP_STORAGE.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rc, err := APP_STORAGE.Get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer rc.Close()
+
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if isExecutableMime(ctype) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+
+	// the local driver's *os.File is seekable, so route it through
+	// http.ServeContent for Range/If-Modified-Since/ETag support (video
+	// scrubbing, resumable downloads, browser caching); S3's GetObject body
+	// isn't seekable, so it falls back to a plain copy
+	if seeker, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime, seeker)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	io.Copy(w, rc)
+}
+
+// uploadHandler reads a regular (non-tus) POST / upload straight off a
+// multipart.Reader instead of r.ParseMultipartForm, so the file part streams
+// into stageUpload part-by-part instead of first being buffered in memory by
+// ParseMultipartForm's own maxMemory. This means the "key" field must come
+// before the "file" field in the request body (true of every client this
+// project targets: browser forms submit fields in DOM order, curl -F sends
+// them in flag order) — the key is checked as soon as the file part arrives,
+// so a key sent after it is not seen. A "ttl" field is honored wherever it
+// appears, since it's only applied once every part has been read.
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("File upload initiated!")
 	// convert our MB size limit to bytes (by shifting 20 bits), and compare with the file size
 	byteMaxSize := mbToBytes(APP_CONFIG.MaxFileSize)
-	// specified maximmum upload size
-	r.ParseMultipartForm(byteMaxSize)
-
-	// if public uploading is disabled, make sure the user has a valid key
-	if APP_CONFIG.PublicUpload == false {
-		var key string
-		if key = r.FormValue("key"); key == "" {
-			w.Write([]byte("Public uploading is currently disabled, go away\n"))
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		w.Write([]byte("Malformed multipart upload\n"))
+		return
+	}
+
+	var key, ttl string
+	var keyRec *keyRecord
+	var staged stagedUpload
+	keyChecked := false
+	staging := false
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.Write([]byte("Malformed multipart upload\n"))
 			return
 		}
 
-		if isUploadKeyValid(key) != true {
-			w.Write([]byte("Incorrect key, sorry gotta go!\n"))
+		switch part.FormName() {
+		case "key":
+			key = readSmallFormValue(part)
+		case "ttl":
+			ttl = readSmallFormValue(part)
+		case "file":
+			// the key gate runs here, not after the loop, so a per-key
+			// MaxFileSize override (same as tusCreate applies) is already
+			// known before stageUpload enforces its own size limit
+			if !keyChecked {
+				if APP_CONFIG.PublicUpload == false {
+					if key == "" {
+						w.Write([]byte("Public uploading is currently disabled, go away\n"))
+						return
+					}
+
+					rec, err := validateUploadKey(key)
+					if err != nil {
+						w.Write([]byte(err.Error() + "\n"))
+						return
+					}
+					keyRec = rec
+				}
+				keyChecked = true
+			}
+
+			maxSize := byteMaxSize
+			if keyRec != nil && keyRec.MaxFileSize > 0 {
+				maxSize = mbToBytes(keyRec.MaxFileSize)
+			}
+
+			log.Printf("Uploaded File: %+v\n", part.FileName())
+
+			staged, err = stageUpload(part, part.FileName(), maxSize)
+			if err != nil {
+				w.Write([]byte(err.Error() + "\n"))
+				return
+			}
+			staging = true
+		}
+		part.Close()
+	}
+
+	if !staging {
+		log.Printf("Error retriving file from multipart form: no file part present")
+		return
+	}
+	log.Printf("File Size: %+v\n", staged.size)
+
+	if keyRec != nil {
+		// checks the quota and reserves the bytes atomically, so two
+		// concurrent uploads on the same key can't both slip in under quota
+		if err := reserveKeyQuota(keyRec.ID, staged.size, staged.mtype); err != nil {
+			cleanupStagedUpload(staged)
+			w.Write([]byte(err.Error() + "\n"))
 			return
 		}
 	}
 
-	file, handler, err := r.FormFile("file")
-	defer file.Close()
+	result, err := commitStagedUpload(staged, resolveTTL(ttl))
 	if err != nil {
-		log.Printf("Error retriving file from multipart form: %s", err.Error())
+		log.Printf("Error while finalizing upload: %s", err.Error())
 		return
 	}
-	// disable when done debugging (probably)
-	log.Printf("Uploaded File: %+v\n", handler.Filename)
-	log.Printf("File Size: %+v\n", handler.Size)
-	log.Printf("MIME Header: %+v\n", handler.Header)
 
-	// file's too big
-	if handler.Size > byteMaxSize {
-		w.Write([]byte(fmt.Sprintf("The maximum file size is currently %dMB, you uploaded a %dMB file...\n", APP_CONFIG.MaxFileSize, handler.Size>>20)))
+	url := fmt.Sprintf("http://localhost:%s/storage/%s", APP_CONFIG.Port, result.Filename)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			URL       string `json:"url"`
+			DeleteURL string `json:"delete_url"`
+			Mime      string `json:"mime"`
+			Size      int64  `json:"size"`
+			ExpiresAt int64  `json:"expires_at"`
+		}{
+			URL:       url,
+			DeleteURL: fmt.Sprintf("%s?token=%s", url, result.DeleteToken),
+			Mime:      result.Mime,
+			Size:      result.Size,
+			ExpiresAt: result.ExpiresAt,
+		})
 		return
 	}
 
-	// generate timestamp, then create a hashid from it
+	// send the user back the location of the file
+	w.Write([]byte(url + "\n"))
+}
+
+// newUploadID generates a short hashid from the current timestamp, used to name
+// both regular and tus-resumed uploads
+func newUploadID() (string, error) {
 	stamp := time.Now().Unix() << 32
 	hashData := hashids.NewData()
 	hashData.MinLength = 6
 	generator, err := hashids.NewWithData(hashData)
+	if err != nil {
+		return "", err
+	}
 
-	id, err := generator.Encode([]int{int(stamp)})
+	return generator.Encode([]int{int(stamp)})
+}
+
+// uploadResult describes an upload that's been fully committed to storage,
+// enough to answer both the plain-text and JSON upload responses
+type uploadResult struct {
+	Filename    string
+	Mime        string
+	Size        int64
+	ExpiresAt   int64
+	DeleteToken string
+}
+
+// smallFormValueLimit caps how much of a non-file multipart part
+// readSmallFormValue will read, so a mislabeled "key"/"ttl" part can't be
+// used to buffer an unbounded amount of data in memory
+const smallFormValueLimit = 4096
 
+// readSmallFormValue reads a non-file multipart part (e.g. "key", "ttl") into
+// a string, bounded by smallFormValueLimit
+func readSmallFormValue(part *multipart.Part) string {
+	data, err := io.ReadAll(io.LimitReader(part, smallFormValueLimit))
 	if err != nil {
-		log.Printf("error while creating hashid: %s", err)
-		return
+		return ""
+	}
+
+	return string(data)
+}
+
+// sniffHeaderSize is how much of an upload stageUpload reads into memory
+// before sniffing its MIME type; mimetype only needs the file's first few KB
+const sniffHeaderSize = 3072
+
+// stagedUpload is an upload that's been streamed to a temp file and hashed,
+// but not yet committed to storage. mimeAllowed has already been checked
+// against the sniffed type; size-based checks (key quotas) still need size.
+type stagedUpload struct {
+	tmpPath string
+	hash    string
+	mtype   string
+	ext     string
+	size    int64
+}
+
+// stageUpload copies body through an io.MultiWriter fanning out to a temp
+// file under StorageDir/tmp and an md5 hasher, so neither the full upload nor
+// its digest ever needs to sit in memory at once. It sniffs the real content
+// type off the first sniffHeaderSize bytes and rejects disallowed MIME types
+// before finishing the copy. maxSize is enforced against the actual bytes
+// read, not just the client-supplied Content-Length. Callers that don't go
+// on to commitStagedUpload must call cleanupStagedUpload themselves.
+func stageUpload(body io.Reader, filename string, maxSize int64) (stagedUpload, error) {
+	tmpDir := filepath.Join(APP_CONFIG.StorageDir, "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return stagedUpload{}, fmt.Errorf("error while preparing tmp directory: %s", err.Error())
 	}
 
-	// read contents of form file into buffer
-	buf, err := ioutil.ReadAll(file)
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
 	if err != nil {
-		log.Printf("Error while reading multipart file into buffer: %s", err.Error())
-		return
+		return stagedUpload{}, fmt.Errorf("error while creating temp file: %s", err.Error())
 	}
+	defer tmp.Close()
 
-	// filePath is the storage dir/files, and our id+the uploaded file's extension
-	uploadedFilename := id + filepath.Ext(handler.Filename)
-	filePath := filepath.Join(filepath.Join(APP_CONFIG.StorageDir, "/files"), uploadedFilename)
+	header := make([]byte, sniffHeaderSize)
+	n, err := io.ReadFull(body, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		os.Remove(tmp.Name())
+		return stagedUpload{}, fmt.Errorf("error while reading upload: %s", err.Error())
+	}
+	header = header[:n]
 
-	// get hash of file to check if it's already been uploaded
-	hash := getBufferFileHash(&buf)
-	hashPath := filepath.Join(APP_CONFIG.StorageDir, "/hashes", hash)
-	// check if filename with hash exists under /hashes
-	if _, err := os.Stat(hashPath); err == nil {
-		// hash exists, give user the already existant file
-		hashFilename, err := ioutil.ReadFile(hashPath)
-		if err != nil {
-			log.Printf("Error while trying to read hashfile!: %s", err)
-		}
+	mtype, sniffedExt := sniffMime(header)
+	if err := mimeAllowed(mtype); err != nil {
+		os.Remove(tmp.Name())
+		return stagedUpload{}, err
+	}
+
+	ext := sniffedExt
+	if ext == "" {
+		ext = filepath.Ext(filename)
+	}
+
+	hasher := md5.New()
+	writer := io.MultiWriter(tmp, hasher)
+
+	if _, err := writer.Write(header); err != nil {
+		os.Remove(tmp.Name())
+		return stagedUpload{}, fmt.Errorf("error while writing temp file: %s", err.Error())
+	}
+
+	// +1 so a body exactly at the limit still copies cleanly, while one a
+	// single byte over trips the size check below instead of silently
+	// truncating
+	written, err := io.Copy(writer, io.LimitReader(body, maxSize-int64(len(header))+1))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return stagedUpload{}, fmt.Errorf("error while writing temp file: %s", err.Error())
+	}
+
+	size := int64(len(header)) + written
+	if size > maxSize {
+		os.Remove(tmp.Name())
+		return stagedUpload{}, fmt.Errorf("The maximum file size is currently %dMB, you uploaded a %dMB file...", maxSize>>20, size>>20)
+	}
+
+	return stagedUpload{
+		tmpPath: tmp.Name(),
+		hash:    hex.EncodeToString(hasher.Sum(nil)),
+		mtype:   mtype,
+		ext:     ext,
+		size:    size,
+	}, nil
+}
+
+// cleanupStagedUpload discards a staged upload that's never going to be
+// committed (e.g. it failed a post-stage quota check)
+func cleanupStagedUpload(u stagedUpload) {
+	os.Remove(u.tmpPath)
+}
+
+// stageCompletedFile builds a stagedUpload from a file that's already
+// complete on disk (a finished tus .part file), sniffing its MIME type and
+// hashing it in place rather than copying it into a fresh temp file first —
+// path doubles as the stagedUpload's tmpPath, so commitStagedUpload moves or
+// discards it exactly like one produced by stageUpload. fallbackExt is used
+// when sniffMime can't determine an extension (tusCreate already derived one
+// from Upload-Metadata's filename, if any).
+func stageCompletedFile(path string, fallbackExt string) (stagedUpload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return stagedUpload{}, fmt.Errorf("error while opening upload: %s", err.Error())
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return stagedUpload{}, fmt.Errorf("error while reading upload: %s", err.Error())
+	}
+	header = header[:n]
+
+	mtype, sniffedExt := sniffMime(header)
+	if err := mimeAllowed(mtype); err != nil {
+		return stagedUpload{}, err
+	}
+
+	ext := sniffedExt
+	if ext == "" {
+		ext = fallbackExt
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return stagedUpload{}, fmt.Errorf("error while reading upload: %s", err.Error())
+	}
 
-		// new filename is the contents of the read hashfile
-		filePath = filepath.Join(filepath.Join(APP_CONFIG.StorageDir, "/files"), string(hashFilename))
+	hasher := md5.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return stagedUpload{}, fmt.Errorf("error while hashing upload: %s", err.Error())
+	}
+
+	return stagedUpload{
+		tmpPath: path,
+		hash:    hex.EncodeToString(hasher.Sum(nil)),
+		mtype:   mtype,
+		ext:     ext,
+		size:    size,
+	}, nil
+}
+
+// commitStagedUpload runs the hashid naming + md5 dedup pipeline against a
+// staged upload, handing its temp file to the Storage backend (or discarding
+// it in favor of an existing dedup match), and returns the resulting
+// uploadResult. ttlHours schedules the upload (or this dedup reference to it)
+// for expiry.
+func commitStagedUpload(u stagedUpload, ttlHours int64) (uploadResult, error) {
+	id, err := newUploadID()
+	if err != nil {
+		cleanupStagedUpload(u)
+		return uploadResult{}, fmt.Errorf("error while creating hashid: %s", err.Error())
+	}
+
+	uploadedFilename := id + u.ext
+
+	if existing, ok := APP_STORAGE.HashExists(u.hash); ok {
+		// hash exists, give user the already existant file
+		uploadedFilename = existing
+		cleanupStagedUpload(u)
 	} else {
-		// create file with the filename as it's contents, give it the name of the hash
-		err = ioutil.WriteFile(hashPath, []byte(uploadedFilename+"\n"), 0644)
-		if err != nil {
+		// record the hash -> filename mapping so future uploads of the same bytes dedup
+		if err := APP_STORAGE.Put("hashes/"+u.hash, strings.NewReader(uploadedFilename+"\n")); err != nil {
 			log.Printf("Error while attempting to write hashfile: %s", err.Error())
 		}
 
-		// write buffer to to new file
-		err = ioutil.WriteFile(filePath, buf, 0644)
-		if err != nil {
-			log.Printf("Eror while attempting to write buffer to new file: %s", err.Error())
-			return
+		if err := APP_STORAGE.PutFile("files/"+uploadedFilename, u.tmpPath); err != nil {
+			return uploadResult{}, fmt.Errorf("error while moving upload into storage: %s", err.Error())
 		}
 	}
 
-	// send the user back the location of the file
-	w.Write([]byte(fmt.Sprintf("http://localhost:%s/storage/%s\n", APP_CONFIG.Port, filepath.Base(filePath))))
+	expiresAt, err := recordExpiry(uploadedFilename, u.hash, ttlHours)
+	if err != nil {
+		log.Printf("Error while recording expiry: %s", err.Error())
+	}
+
+	deleteToken, err := getOrCreateDeleteToken(uploadedFilename)
+	if err != nil {
+		log.Printf("Error while creating delete token: %s", err.Error())
+	}
+
+	return uploadResult{
+		Filename:    uploadedFilename,
+		Mime:        u.mtype,
+		Size:        u.size,
+		ExpiresAt:   expiresAt,
+		DeleteToken: deleteToken,
+	}, nil
 }
 
 func main() {
@@ -258,12 +608,44 @@ func main() {
 	// global config so handlers can access (yeah yeah globals but this is a small program who cares)
 	APP_CONFIG = conf
 
+	// restrict filesystem access to StorageDir and cap resource limits; a
+	// no-op on non-Linux, and best-effort even on Linux
+	if err := applySandbox(conf); err != nil {
+		log.Printf("Warning: sandboxing not fully applied: %s", err.Error())
+	}
+
+	// set up the storage backend (local disk or S3, per ATAERU_STORAGE_DRIVER)
+	storage, err := newStorage(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	APP_STORAGE = storage
+
+	// track per-upload expiry and sweep expired files once a minute
+	db, err := openMetaDB(conf.StorageDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	metaDB = db
+	startExpirySweeper()
+
+	// one-time import of the old flat StorageDir/keys file into keysBucket
+	if err := migrateLegacyKeys(conf.StorageDir); err != nil {
+		log.Printf("Error while migrating legacy keys: %s", err.Error())
+	}
+
 	// create router
 	mux := http.NewServeMux()
 
-	// fileserver for uploaded files
-	fs := http.FileServer(http.Dir(filepath.Join(conf.StorageDir, "/files")))
-	mux.Handle("/storage/", http.StripPrefix("/storage/", disableDirListing(fs)))
+	// streams uploaded files out of APP_STORAGE
+	mux.Handle("/storage/", http.StripPrefix("/storage/", disableDirListing(http.HandlerFunc(storageHandler))))
+
+	// tus.io resumable uploads
+	mux.HandleFunc("/files/", tusHandler)
+
+	// key management admin API, guarded by ATAERU_ADMIN_TOKEN
+	mux.HandleFunc("/admin/keys", adminKeysHandler)
+	mux.HandleFunc("/admin/keys/", adminKeysHandler)
 
 	// index (routes between landing and upload)
 	mux.HandleFunc("/", indexHandler)
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// metaDB stores per-file expiry metadata in StorageDir/meta.db
+var metaDB *bbolt.DB
+
+var expiryBucket = []byte("expiry")
+
+// fileMeta is the bbolt value stored per uploaded filename. Hash is kept
+// alongside the expiry list so the sweeper can clean up the /hashes mapping
+// once every reference has expired
+type fileMeta struct {
+	Hash        string  `json:"hash"`
+	Expires     []int64 `json:"expires"`
+	DeleteToken string  `json:"delete_token"`
+	// Permanent is set once any reference to this file was uploaded with
+	// ttl=0 ("never expires"). It sticks regardless of what finite TTLs
+	// later dedup hits attach to the same record, so a permanent upload
+	// can't be force-expired by someone re-uploading identical bytes with a
+	// short TTL.
+	Permanent bool `json:"permanent,omitempty"`
+}
+
+func openMetaDB(storageDir string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(filepath.Join(storageDir, "meta.db"), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(expiryBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// resolveTTL figures out the TTL (in hours) that should apply to an upload:
+// the requested value if present and valid, else ATAERU_DEFAULT_TTL, capped
+// at ATAERU_MAX_TTL when one is configured. A TTL of 0 means "never expires"
+func resolveTTL(requested string) int64 {
+	ttl := APP_CONFIG.DefaultTTL
+	if requested != "" {
+		if parsed, err := strconv.ParseInt(requested, 10, 64); err == nil && parsed >= 0 {
+			ttl = parsed
+		}
+	}
+
+	if APP_CONFIG.MaxTTL > 0 && (ttl <= 0 || ttl > APP_CONFIG.MaxTTL) {
+		ttl = APP_CONFIG.MaxTTL
+	}
+
+	return ttl
+}
+
+// recordExpiry records a reference to filename: a finite TTL appends an
+// expiry entry, while ttlHours <= 0 ("never expires") marks the record
+// Permanent instead, returning the resulting expiry time (0 for a permanent
+// reference). Dedup hits run this against the same filename's existing
+// record, so the file is only purged once every uploader's reference has
+// expired — and never, once any of them was permanent.
+func recordExpiry(filename, hash string, ttlHours int64) (int64, error) {
+	var expiresAt int64
+	if ttlHours > 0 {
+		expiresAt = time.Now().Add(time.Duration(ttlHours) * time.Hour).Unix()
+	}
+
+	err := metaDB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(expiryBucket)
+
+		var m fileMeta
+		if data := b.Get([]byte(filename)); data != nil {
+			if err := json.Unmarshal(data, &m); err != nil {
+				return err
+			}
+		}
+
+		if m.Hash == "" {
+			m.Hash = hash
+		}
+
+		if ttlHours > 0 {
+			m.Expires = append(m.Expires, expiresAt)
+		} else {
+			m.Permanent = true
+		}
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(filename), data)
+	})
+
+	return expiresAt, err
+}
+
+// getOrCreateDeleteToken returns the token that authorizes deleting filename
+// via the /storage/ DELETE verb, minting one on first call
+func getOrCreateDeleteToken(filename string) (string, error) {
+	var token string
+
+	err := metaDB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(expiryBucket)
+
+		var m fileMeta
+		if data := b.Get([]byte(filename)); data != nil {
+			if err := json.Unmarshal(data, &m); err != nil {
+				return err
+			}
+		}
+
+		if m.DeleteToken == "" {
+			tokenBytes := make([]byte, 16)
+			if _, err := rand.Read(tokenBytes); err != nil {
+				return err
+			}
+			m.DeleteToken = hex.EncodeToString(tokenBytes)
+		}
+		token = m.DeleteToken
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(filename), data)
+	})
+
+	return token, err
+}
+
+// deleteByToken removes filename (and its /hashes mapping) once the given
+// token matches the one minted for it by getOrCreateDeleteToken
+func deleteByToken(filename, token string) error {
+	var hash string
+
+	err := metaDB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(expiryBucket)
+
+		data := b.Get([]byte(filename))
+		if data == nil {
+			return fmt.Errorf("unknown file")
+		}
+
+		var m fileMeta
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+
+		if token == "" || m.DeleteToken == "" || m.DeleteToken != token {
+			return fmt.Errorf("invalid delete token")
+		}
+
+		hash = m.Hash
+		return b.Delete([]byte(filename))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := shredOrDelete("files/" + filename); err != nil {
+		return err
+	}
+
+	if hash != "" {
+		if err := APP_STORAGE.Delete("hashes/" + hash); err != nil {
+			log.Printf("Error while removing hash mapping %s: %s", hash, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// startExpirySweeper runs sweepExpired once a minute for the life of the process
+func startExpirySweeper() {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		for range ticker.C {
+			sweepExpired()
+		}
+	}()
+}
+
+type expiryDecision struct {
+	filename    string
+	hash        string
+	deleteToken string
+	permanent   bool
+	live        []int64
+	purge       bool
+}
+
+// sweepExpired drops expired entries from meta.db, and for any filename whose
+// entries are now all expired, removes the stored file, its /hashes mapping,
+// and any stray tus part files.
+func sweepExpired() {
+	now := time.Now().Unix()
+	var decisions []expiryDecision
+
+	err := metaDB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(expiryBucket).ForEach(func(k, v []byte) error {
+			var m fileMeta
+			if err := json.Unmarshal(v, &m); err != nil {
+				log.Printf("Error while decoding expiry metadata for %s: %s", k, err.Error())
+				return nil
+			}
+
+			live := make([]int64, 0, len(m.Expires))
+			for _, exp := range m.Expires {
+				if exp > now {
+					live = append(live, exp)
+				}
+			}
+
+			decisions = append(decisions, expiryDecision{
+				filename:    string(k),
+				hash:        m.Hash,
+				deleteToken: m.DeleteToken,
+				permanent:   m.Permanent,
+				live:        live,
+				// only purge records that actually had TTLs attached and were
+				// never marked Permanent; a record that exists purely to hold
+				// a delete token, or that has a permanent reference alongside
+				// expired finite ones, must not expire
+				purge: !m.Permanent && len(m.Expires) > 0 && len(live) == 0,
+			})
+
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Error while scanning expiry metadata: %s", err.Error())
+		return
+	}
+
+	for _, d := range decisions {
+		if d.purge {
+			removeExpiredFile(d.filename, d.hash)
+			continue
+		}
+
+		data, err := json.Marshal(fileMeta{Hash: d.hash, Expires: d.live, DeleteToken: d.deleteToken, Permanent: d.permanent})
+		if err != nil {
+			log.Printf("Error while re-encoding expiry metadata for %s: %s", d.filename, err.Error())
+			continue
+		}
+
+		if err := metaDB.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket(expiryBucket).Put([]byte(d.filename), data)
+		}); err != nil {
+			log.Printf("Error while updating expiry metadata for %s: %s", d.filename, err.Error())
+		}
+	}
+}
+
+func removeExpiredFile(filename, hash string) {
+	if err := shredOrDelete("files/" + filename); err != nil {
+		log.Printf("Error while removing expired file %s: %s", filename, err.Error())
+	}
+
+	if hash != "" {
+		if err := APP_STORAGE.Delete("hashes/" + hash); err != nil {
+			log.Printf("Error while removing expired hash mapping %s: %s", hash, err.Error())
+		}
+	}
+
+	// defensive: a tus part/info file can only share this name if tusFinish
+	// was never reached, but clean it up anyway
+	os.Remove(tusPartPath(filename))
+	os.Remove(tusInfoPath(filename))
+
+	if err := metaDB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(expiryBucket).Delete([]byte(filename))
+	}); err != nil {
+		log.Printf("Error while removing expiry record for %s: %s", filename, err.Error())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// sniffMime detects the real content type of buf via magic-byte detection
+// rather than trusting a client-supplied filename extension
+func sniffMime(buf []byte) (mime string, ext string) {
+	mtype := mimetype.Detect(buf)
+	return mtype.String(), mtype.Extension()
+}
+
+// mimeAllowed checks mtype against the ATAERU_MIME_ALLOW/ATAERU_MIME_DENY glob
+// lists (e.g. "image/*", "application/x-msdownload"). Deny takes precedence;
+// an empty allow list permits anything not denied.
+func mimeAllowed(mtype string) error {
+	for _, pattern := range APP_CONFIG.MimeDeny {
+		if mimeMatches(pattern, mtype) {
+			return fmt.Errorf("uploads of type %s are not permitted", mtype)
+		}
+	}
+
+	if len(APP_CONFIG.MimeAllow) == 0 {
+		return nil
+	}
+
+	for _, pattern := range APP_CONFIG.MimeAllow {
+		if mimeMatches(pattern, mtype) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("uploads of type %s are not permitted", mtype)
+}
+
+func mimeMatches(pattern, mtype string) bool {
+	matched, err := path.Match(pattern, mtype)
+	return err == nil && matched
+}
+
+// executableMimePatterns get a forced Content-Disposition: attachment when
+// served back from /storage/, so a browser won't run them inline
+var executableMimePatterns = []string{
+	"application/x-msdownload",
+	"application/x-executable",
+	"application/x-sh",
+	"application/x-elf",
+	"application/vnd.microsoft.portable-executable",
+	"text/html",
+	"image/svg+xml",
+	"application/javascript",
+	"text/javascript",
+}
+
+func isExecutableMime(mtype string) bool {
+	mtype = strings.TrimSpace(strings.SplitN(mtype, ";", 2)[0])
+	for _, pattern := range executableMimePatterns {
+		if mimeMatches(pattern, mtype) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCSV splits a comma separated env var into its trimmed, non-empty parts
+func splitCSV(s string) []string {
+	var parts []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return parts
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Storage implements Storage against any S3-compatible API (AWS S3, MinIO,
+// Backblaze B2, Cloudflare R2, ...), configured entirely through env vars.
+// Only uploaded files and hash mappings live in the bucket; meta.db (expiry
+// records and keys) and in-progress tus uploads stay on local disk.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3Storage(conf config) (*s3Storage, error) {
+	if conf.S3Bucket == "" {
+		return nil, fmt.Errorf("ATAERU_S3_BUCKET must be set when ATAERU_STORAGE_DRIVER=s3")
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(getEnvOrDefault("ATAERU_S3_REGION", "us-east-1")),
+	}
+
+	if accessKey := os.Getenv("ATAERU_S3_ACCESS_KEY"); accessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			accessKey, os.Getenv("ATAERU_S3_SECRET_KEY"), "",
+		)))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading S3 config: %s", err.Error())
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = true
+		if conf.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(conf.S3Endpoint)
+		}
+	})
+
+	return &s3Storage{client: client, bucket: conf.S3Bucket}, nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   r,
+	})
+
+	return err
+}
+
+func (s *s3Storage) PutFile(name string, tmpPath string) error {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := s.Put(name, f); err != nil {
+		return err
+	}
+
+	return os.Remove(tmpPath)
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (s *s3Storage) Stat(name string) (Info, error) {
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return Info{}, err
+	}
+
+	info := Info{Name: name}
+	if out.ContentLength != nil {
+		info.Size = *out.ContentLength
+	}
+	if out.LastModified != nil {
+		info.ModTime = *out.LastModified
+	}
+
+	return info, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+
+	return err
+}
+
+func (s *s3Storage) HashExists(hash string) (string, bool) {
+	rc, err := s.Get("hashes/" + hash)
+	if err != nil {
+		return "", false
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(data)), true
+}
@@ -0,0 +1,8 @@
+//go:build !(linux && seccomp)
+
+package main
+
+// applySeccomp is a no-op unless built with -tags seccomp on Linux
+func applySeccomp() error {
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// applySandbox is a no-op outside Linux; Landlock and seccomp are Linux-only
+func applySandbox(conf config) error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+)
+
+const shredPasses = 7
+
+// Shred overwrites a file with several passes of crypto/rand bytes followed by
+// a final zero pass before unlinking it, so its prior contents can't be
+// recovered from disk. Only meaningful against local paths; guarded at the
+// call site by ATAERU_SECURE_DELETE.
+func Shred(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i := 0; i < shredPasses; i++ {
+		if err := overwrite(f, rand.Reader, size); err != nil {
+			return err
+		}
+	}
+
+	// final zero pass
+	if err := overwrite(f, zeroReader{}, size); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func overwrite(f *os.File, src io.Reader, size int64) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, src, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// zeroReader is an io.Reader that yields an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// shredOrDelete removes a storage object, securely shredding it first when
+// ATAERU_SECURE_DELETE is enabled and the active backend is local disk (object
+// storage backends have no local path to overwrite, so they fall back to a
+// plain delete)
+func shredOrDelete(name string) error {
+	if APP_CONFIG.SecureDelete {
+		if ls, ok := APP_STORAGE.(*localStorage); ok {
+			return Shred(ls.path(name))
+		}
+	}
+
+	return APP_STORAGE.Delete(name)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// APP_STORAGE is the active storage backend, selected in main() based on
+// ATAERU_STORAGE_DRIVER
+var APP_STORAGE Storage
+
+// Info describes a stored object, analogous to os.FileInfo but backend-agnostic
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage abstracts where uploaded files and hash mappings actually live, so
+// Ataeru can run against the local disk or an S3-compatible bucket without
+// uploadHandler/tusHandler caring which. In-progress tus parts don't go
+// through it: they always stay on local disk under StorageDir/uploads.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (Info, error)
+	Delete(name string) error
+	// HashExists looks up the hashes/<hash> entry and, if present, returns the
+	// filename it points at
+	HashExists(hash string) (string, bool)
+	// PutFile stores the already-on-disk file at tmpPath as name, taking
+	// tmpPath's contents rather than its path once it returns. Local storage
+	// renames it in place; other backends stream it in and remove it after.
+	PutFile(name string, tmpPath string) error
+}
+
+// newStorage builds the configured Storage backend
+func newStorage(conf config) (Storage, error) {
+	switch conf.StorageDriver {
+	case "s3":
+		return newS3Storage(conf)
+	case "local", "":
+		return newLocalStorage(conf.StorageDir), nil
+	default:
+		return nil, fmt.Errorf("unknown ATAERU_STORAGE_DRIVER: %s", conf.StorageDriver)
+	}
+}
+
+// localStorage implements Storage directly on top of StorageDir
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) *localStorage {
+	return &localStorage{dir: dir}
+}
+
+// path resolves a storage-relative name to its absolute on-disk location
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *localStorage) Put(name string, r io.Reader) error {
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *localStorage) PutFile(name string, tmpPath string) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// tmpPath is already on the same filesystem as the rest of StorageDir
+	// (see stageUpload), so this is an instant rename rather than a copy
+	return os.Rename(tmpPath, path)
+}
+
+func (s *localStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+func (s *localStorage) Stat(name string) (Info, error) {
+	fi, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+func (s *localStorage) HashExists(hash string) (string, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "hashes", hash))
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(data)), true
+}
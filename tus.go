@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tus.io resumable upload protocol (v1.0.0) support, registered on /files/.
+// See https://tus.io/protocols/resumable-upload.html
+
+const tusVersion = "1.0.0"
+
+// tusExtensions must only list extensions actually implemented below —
+// advertising "checksum" or "expiration" here without honoring
+// Upload-Checksum or setting Upload-Expires would make a spec-conformant
+// client believe the server does something it doesn't
+const tusExtensions = "creation,creation-with-upload,termination"
+
+// tusUpload tracks the state of an in-progress resumable upload. It's persisted
+// to StorageDir/uploads/<id>.json alongside the .part file so a restart doesn't
+// lose track of offset/metadata.
+type tusUpload struct {
+	ID       string `json:"id"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Metadata string `json:"metadata"`
+	Ext      string `json:"ext"`
+	TTL      int64  `json:"ttl"`
+	// Key is the upload key supplied via Upload-Metadata (see
+	// tusAuthorize), re-validated on every PATCH and at finalize so the same
+	// ATAERU_PUBLIC_UPLOAD/quota gate uploadHandler enforces on POST / also
+	// applies to resumable uploads made through /files/
+	Key string `json:"key,omitempty"`
+}
+
+// tusMu guards concurrent PATCH/HEAD/DELETE requests against the same upload
+var tusMu sync.Mutex
+
+func tusUploadDir() string {
+	return filepath.Join(APP_CONFIG.StorageDir, "/uploads")
+}
+
+func tusPartPath(id string) string {
+	return filepath.Join(tusUploadDir(), id+".part")
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(tusUploadDir(), id+".json")
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	data, err := ioutil.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func saveTusUpload(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(tusInfoPath(u.ID), data, 0644)
+}
+
+// tusCommonHeaders sets the headers every tus response must carry
+func tusCommonHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+}
+
+// tusHandler dispatches the tus verbs used to create, extend, query and cancel
+// a resumable upload. Finished uploads are handed off to tusFinish so the
+// resulting file lands in /files with the same hashid + md5 dedup pipeline as
+// a regular multipart upload.
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	tusCommonHeaders(w)
+
+	switch r.Method {
+	case http.MethodOptions:
+		tusOptions(w, r)
+	case http.MethodPost:
+		tusCreate(w, r)
+	case http.MethodPatch:
+		tusPatch(w, r)
+	case http.MethodHead:
+		tusHead(w, r)
+	case http.MethodDelete:
+		tusDelete(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(mbToBytes(APP_CONFIG.MaxFileSize), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusAuthorize enforces the same ATAERU_PUBLIC_UPLOAD/key gate uploadHandler
+// applies to POST /, for a key carried in the tus upload's "key"
+// Upload-Metadata pair. It returns the validated keyRecord (nil when public
+// uploads are enabled) or writes an error response and returns ok=false.
+func tusAuthorize(w http.ResponseWriter, key string) (rec *keyRecord, ok bool) {
+	if APP_CONFIG.PublicUpload {
+		return nil, true
+	}
+
+	if key == "" {
+		http.Error(w, "Public uploading is currently disabled, go away", http.StatusForbidden)
+		return nil, false
+	}
+
+	rec, err := validateUploadKey(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	return rec, true
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	key := tusMetadataValue(metadata, "key")
+
+	keyRec, ok := tusAuthorize(w, key)
+	if !ok {
+		return
+	}
+
+	maxSizeMB := APP_CONFIG.MaxFileSize
+	if keyRec != nil && keyRec.MaxFileSize > 0 {
+		maxSizeMB = keyRec.MaxFileSize
+	}
+
+	if length > mbToBytes(maxSizeMB) {
+		http.Error(w, fmt.Sprintf("The maximum file size is currently %dMB", maxSizeMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		log.Printf("error while creating hashid: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u := &tusUpload{
+		ID:       id,
+		Offset:   0,
+		Length:   length,
+		Metadata: metadata,
+		Ext:      tusExtFromMetadata(metadata),
+		TTL:      resolveTTL(tusMetadataValue(metadata, "ttl")),
+		Key:      key,
+	}
+
+	f, err := os.Create(tusPartPath(id))
+	if err != nil {
+		log.Printf("Error while creating part file: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := saveTusUpload(u); err != nil {
+		log.Printf("Error while persisting upload state: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/files/%s", id))
+
+	// creation-with-upload: client may include a body along with the POST;
+	// tusAppend then writes the 201 itself, after setting Upload-Offset
+	if r.ContentLength > 0 {
+		tusAppend(w, r, u, http.StatusCreated)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request) {
+	tusMu.Lock()
+	defer tusMu.Unlock()
+
+	id := tusIDFromPath(r.URL.Path)
+	u, err := loadTusUpload(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// re-validate on every chunk, not just at creation, so a key revoked
+	// mid-upload stops accepting further PATCHes
+	if _, ok := tusAuthorize(w, u.Key); !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+		return
+	}
+
+	tusAppend(w, r, u, http.StatusNoContent)
+}
+
+// tusAppend writes the request body onto the end of the .part file, and
+// finalizes the upload once complete. successStatus is the status written
+// when the append succeeds (204 for PATCH, 201 for creation-with-upload)
+func tusAppend(w http.ResponseWriter, r *http.Request, u *tusUpload, successStatus int) {
+	f, err := os.OpenFile(tusPartPath(u.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error while opening part file: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// cap at what's left of Upload-Length, so a client can't grow the .part
+	// file past the size that was already checked against Tus-Max-Size; EOF
+	// before that many bytes just means this chunk didn't fill the rest
+	written, err := io.CopyN(f, r.Body, u.Length-u.Offset)
+	if err != nil && err != io.EOF {
+		log.Printf("Error while writing to part file: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u.Offset += written
+	if err := saveTusUpload(u); err != nil {
+		log.Printf("Error while persisting upload state: %s", err.Error())
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+
+	if u.Offset >= u.Length {
+		if err := tusFinish(u); err != nil {
+			log.Printf("Error while finalizing tus upload: %s", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(successStatus)
+}
+
+// tusFinish moves a completed upload through the regular dedup pipeline and
+// removes its info file. The .part file itself isn't read into memory: it's
+// staged in place (see stageCompletedFile) and handed to commitStagedUpload,
+// the same streaming path stageUpload/uploadHandler use for POST /.
+func tusFinish(u *tusUpload) error {
+	staged, err := stageCompletedFile(tusPartPath(u.ID), u.Ext)
+	if err != nil {
+		return err
+	}
+
+	// re-validate the key and reserve its quota (now that the final size is
+	// known) at finalize time too, same as uploadHandler does for POST /
+	if !APP_CONFIG.PublicUpload {
+		keyRec, err := validateUploadKey(u.Key)
+		if err != nil {
+			cleanupStagedUpload(staged)
+			return err
+		}
+
+		if err := reserveKeyQuota(keyRec.ID, staged.size, staged.mtype); err != nil {
+			cleanupStagedUpload(staged)
+			return err
+		}
+	}
+
+	if _, err := commitStagedUpload(staged, u.TTL); err != nil {
+		return err
+	}
+
+	os.Remove(tusInfoPath(u.ID))
+
+	return nil
+}
+
+func tusHead(w http.ResponseWriter, r *http.Request) {
+	tusMu.Lock()
+	defer tusMu.Unlock()
+
+	id := tusIDFromPath(r.URL.Path)
+	u, err := loadTusUpload(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusDelete(w http.ResponseWriter, r *http.Request) {
+	tusMu.Lock()
+	defer tusMu.Unlock()
+
+	id := tusIDFromPath(r.URL.Path)
+	os.Remove(tusPartPath(id))
+	os.Remove(tusInfoPath(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusIDFromPath(path string) string {
+	return filepath.Base(path)
+}
+
+// tusExtFromMetadata pulls the "filename" pair out of Upload-Metadata and
+// returns its extension
+func tusExtFromMetadata(metadata string) string {
+	if name := tusMetadataValue(metadata, "filename"); name != "" {
+		return filepath.Ext(name)
+	}
+
+	return ""
+}
+
+// tusMetadataValue decodes a single base64-encoded value out of Upload-Metadata
+// (a comma separated list of "key base64value" pairs)
+func tusMetadataValue(metadata, key string) string {
+	for _, pair := range splitTusMetadata(metadata) {
+		if pair[0] == key && len(pair) > 1 {
+			if value, err := tusDecodeMetadataValue(pair[1]); err == nil {
+				return value
+			}
+		}
+	}
+
+	return ""
+}
+
+// splitTusMetadata parses the comma separated "key base64value" pairs of an
+// Upload-Metadata header into their component parts
+func splitTusMetadata(metadata string) [][]string {
+	var pairs [][]string
+	for _, entry := range strings.Split(metadata, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pairs = append(pairs, strings.SplitN(entry, " ", 2))
+	}
+
+	return pairs
+}
+
+func tusDecodeMetadataValue(value string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decoded), nil
+}